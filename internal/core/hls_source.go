@@ -0,0 +1,700 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/asticode/go-astits"
+	"github.com/pion/rtp"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+const (
+	hlsSourceRetryPause      = 5 * time.Second
+	hlsSourcePayloadTypeH264 = 96
+	hlsSourcePayloadTypeAAC  = 97
+)
+
+// hlsSourceParent has the same shape as rtspSourceParent: hlsSource drives
+// the same sourceExternal lifecycle as rtspSource, just fed by an upstream
+// HLS playlist instead of an upstream RTSP server.
+type hlsSourceParent interface {
+	Log(logger.Level, string, ...interface{})
+	OnSourceExternalSetReady(req sourceExtSetReadyReq)
+	OnSourceExternalSetNotReady(req sourceExtSetNotReadyReq)
+	OnSourceFrame(int, gortsplib.StreamType, []byte)
+}
+
+type hlsSource struct {
+	ur          string
+	readTimeout time.Duration
+	wg          *sync.WaitGroup
+	stats       *stats
+	parent      hlsSourceParent
+
+	httpClient *http.Client
+
+	ctx       context.Context
+	ctxCancel func()
+}
+
+// newHLSSource is constructed directly by callers for now: the path manager
+// (not part of this source tree yet) is expected to recognize an
+// "http://"/"https://" `source` pointing at a `.m3u8` playlist and dispatch
+// to this constructor the same way it dispatches rtsp(s):// sources to
+// newRTSPSource. Until that wiring lands, the source: http://....m3u8 knob
+// isn't reachable from the YAML config.
+func newHLSSource(
+	parentCtx context.Context,
+	ur string,
+	readTimeout time.Duration,
+	wg *sync.WaitGroup,
+	stats *stats,
+	parent hlsSourceParent) *hlsSource {
+	ctx, ctxCancel := context.WithCancel(parentCtx)
+
+	s := &hlsSource{
+		ur:          ur,
+		readTimeout: readTimeout,
+		wg:          wg,
+		stats:       stats,
+		parent:      parent,
+		httpClient: &http.Client{
+			Timeout: readTimeout,
+		},
+		ctx:       ctx,
+		ctxCancel: ctxCancel,
+	}
+
+	atomic.AddInt64(s.stats.CountSourcesHLS, +1)
+	s.log(logger.Info, "started")
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s
+}
+
+func (s *hlsSource) Close() {
+	atomic.AddInt64(s.stats.CountSourcesHLS, -1)
+	s.log(logger.Info, "stopped")
+	s.ctxCancel()
+}
+
+// IsSource implements source.
+func (s *hlsSource) IsSource() {}
+
+// IsSourceExternal implements sourceExternal.
+func (s *hlsSource) IsSourceExternal() {}
+
+func (s *hlsSource) log(level logger.Level, format string, args ...interface{}) {
+	s.parent.Log(level, "[hls source] "+format, args...)
+}
+
+func (s *hlsSource) run() {
+	defer s.wg.Done()
+
+	for {
+		ok := func() bool {
+			ok := s.runInner()
+			if !ok {
+				return false
+			}
+
+			select {
+			case <-time.After(hlsSourceRetryPause):
+				return true
+			case <-s.ctx.Done():
+				return false
+			}
+		}()
+		if !ok {
+			break
+		}
+	}
+
+	s.ctxCancel()
+}
+
+func (s *hlsSource) runInner() bool {
+	s.log(logger.Debug, "connecting")
+
+	dm := &hlsSourceDemuxer{parent: s}
+	lastSeq := -1
+
+	defer func() {
+		if dm.tracksReady {
+			s.parent.OnSourceExternalSetNotReady(sourceExtSetNotReadyReq{})
+		}
+	}()
+
+	for {
+		segments, newLastSeq, err := s.fetchSegmentURLs(lastSeq)
+		if err != nil {
+			s.log(logger.Info, "ERR: %s", err)
+			return true
+		}
+		lastSeq = newLastSeq
+
+		for _, seg := range segments {
+			select {
+			case <-s.ctx.Done():
+				return false
+			default:
+			}
+
+			if err := s.fetchSegment(seg, dm); err != nil {
+				s.log(logger.Info, "ERR: %s", err)
+				return true
+			}
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return false
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// fetchSegmentURLs downloads the playlist (following a single level of
+// variant redirection) and returns the absolute URLs of the segments past
+// lastSeq, in playback order, along with the sequence number of the last
+// one. Segments are identified by their #EXT-X-MEDIA-SEQUENCE-derived
+// position rather than remembered by URL, so a long-lived pull doesn't
+// accumulate one map entry per segment ever seen.
+func (s *hlsSource) fetchSegmentURLs(lastSeq int) ([]string, int, error) {
+	ur := s.ur
+
+	for i := 0; i < 2; i++ {
+		lines, err := s.getLines(ur)
+		if err != nil {
+			return nil, lastSeq, err
+		}
+
+		variant := ""
+		for i, line := range lines {
+			if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") && i+1 < len(lines) {
+				variant = lines[i+1]
+				break
+			}
+		}
+
+		if variant == "" {
+			seq := 0
+			for _, line := range lines {
+				if strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:") {
+					if n, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:")); err == nil {
+						seq = n
+					}
+					break
+				}
+			}
+
+			var segs []string
+			newLastSeq := lastSeq
+
+			for _, line := range lines {
+				if line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+
+				if seq > lastSeq {
+					abs, err := resolveURL(ur, line)
+					if err == nil {
+						segs = append(segs, abs)
+						newLastSeq = seq
+					}
+				}
+
+				seq++
+			}
+
+			return segs, newLastSeq, nil
+		}
+
+		abs, err := resolveURL(ur, variant)
+		if err != nil {
+			return nil, lastSeq, err
+		}
+		ur = abs
+	}
+
+	return nil, lastSeq, fmt.Errorf("too many levels of playlist redirection")
+}
+
+func (s *hlsSource) getLines(ur string) ([]string, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, ur, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	return lines, scanner.Err()
+}
+
+func (s *hlsSource) fetchSegment(ur string, dm *hlsSourceDemuxer) error {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, ur, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	return dm.demux(res.Body)
+}
+
+func resolveURL(base, ref string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+
+	return baseURL.ResolveReference(refURL).String(), nil
+}
+
+// hlsSourceDemuxer turns the MPEG-TS segments of an HLS stream into gortsplib
+// tracks and RTP frames. Tracks aren't announced until real codec config has
+// been observed: SPS/PPS from the first video access unit that carries them,
+// and an AudioSpecificConfig derived from the first ADTS frame header.
+type hlsSourceDemuxer struct {
+	parent *hlsSource
+
+	videoPID uint16
+	audioPID uint16
+
+	sps []byte
+	pps []byte
+
+	audioConfig    []byte
+	audioClockRate int
+
+	tracksReady  bool
+	videoTrackID int
+	audioTrackID int
+	videoSeq     uint16
+	audioSeq     uint16
+}
+
+func (dm *hlsSourceDemuxer) demux(r io.Reader) error {
+	demuxer := astits.NewDemuxer(dm.parent.ctx, r)
+
+	for {
+		data, err := demuxer.NextData()
+		if err != nil {
+			if err == astits.ErrNoMorePackets {
+				return nil
+			}
+			return err
+		}
+
+		switch {
+		case data.PMT != nil:
+			dm.onPMT(data.PMT)
+
+		case data.PES != nil:
+			dm.onPES(data)
+		}
+	}
+}
+
+func (dm *hlsSourceDemuxer) onPMT(pmt *astits.PMTData) {
+	if dm.videoPID != 0 || dm.audioPID != 0 {
+		return
+	}
+
+	for _, es := range pmt.ElementaryStreams {
+		switch es.StreamType {
+		case astits.StreamTypeH264Video:
+			dm.videoPID = es.ElementaryPID
+
+		case astits.StreamTypeAACAudio:
+			// LOAS/LATM (StreamTypeAACLOASAudio) isn't handled here: only the
+			// ADTS framing parseADTSHeader/splitADTSFrames expect. Accepting
+			// it without being able to parse it would leave audioConfig nil
+			// forever, which would stall tryCreateTracks and the whole
+			// stream (video included) with no error ever logged.
+			dm.audioPID = es.ElementaryPID
+		}
+	}
+}
+
+func (dm *hlsSourceDemuxer) onPES(data *astits.DemuxerData) {
+	if dm.videoPID == 0 && dm.audioPID == 0 {
+		return
+	}
+
+	pes := data.PES
+	pts := pesTimestamp(pes)
+
+	switch data.PID {
+	case dm.videoPID:
+		dm.onVideoAU(pes.Data, pts)
+
+	case dm.audioPID:
+		dm.onAudioAU(pes.Data, pts)
+	}
+}
+
+// onVideoAU collects the SPS/PPS out of the Annex-B access unit, if it
+// carries them, then forwards the access unit as RTP once enough codec
+// config is known to announce tracks.
+func (dm *hlsSourceDemuxer) onVideoAU(au []byte, pts uint32) {
+	nalus := splitAnnexB(au)
+
+	if !dm.tracksReady {
+		for _, nalu := range nalus {
+			if len(nalu) == 0 {
+				continue
+			}
+
+			switch nalu[0] & 0x1f {
+			case 7:
+				dm.sps = append([]byte(nil), nalu...)
+			case 8:
+				dm.pps = append([]byte(nil), nalu...)
+			}
+		}
+
+		if !dm.tryCreateTracks() {
+			return
+		}
+	}
+
+	dm.writeVideo(nalus, pts)
+}
+
+// onAudioAU splits the PES payload into the (possibly several) ADTS frames
+// it carries, extracts the AudioSpecificConfig out of the first one, then
+// forwards each frame as its own RTP packet once enough codec config is
+// known to announce tracks. Each frame covers 1024 samples, so the
+// track-clock timestamp, derived from the PES PTS, is advanced by that much
+// per frame.
+func (dm *hlsSourceDemuxer) onAudioAU(au []byte, pts uint32) {
+	frames := splitADTSFrames(au)
+	if len(frames) == 0 {
+		return
+	}
+
+	if !dm.tracksReady {
+		if dm.audioConfig == nil {
+			dm.parseADTSHeader(frames[0])
+		}
+
+		if !dm.tryCreateTracks() {
+			return
+		}
+	}
+
+	ts := rescalePTS(pts, dm.audioClockRate)
+
+	for _, frame := range frames {
+		dm.writeAudio(stripADTSHeader(frame), ts)
+		ts += 1024
+	}
+}
+
+// splitADTSFrames walks a run of concatenated ADTS frames (ISO/IEC 13818-7
+// Annex B), as routinely packed into a single TS audio PES, using the
+// 13-bit frame-length field in each header to find the next one.
+func splitADTSFrames(payload []byte) [][]byte {
+	var frames [][]byte
+
+	for len(payload) >= 7 {
+		if payload[0] != 0xff || payload[1]&0xf0 != 0xf0 {
+			break
+		}
+
+		frameLen := (int(payload[3]&0x03) << 11) | (int(payload[4]) << 3) | (int(payload[5]) >> 5)
+		if frameLen < 7 || frameLen > len(payload) {
+			break
+		}
+
+		frames = append(frames, payload[:frameLen])
+		payload = payload[frameLen:]
+	}
+
+	return frames
+}
+
+// tryCreateTracks announces the tracks once real codec config is available
+// for every elementary stream found in the PMT. It returns false, without
+// side effects, until that happens.
+func (dm *hlsSourceDemuxer) tryCreateTracks() bool {
+	if dm.videoPID != 0 && (dm.sps == nil || dm.pps == nil) {
+		return false
+	}
+	if dm.audioPID != 0 && dm.audioConfig == nil {
+		return false
+	}
+
+	var tracks []*gortsplib.Track
+	dm.videoTrackID = -1
+	dm.audioTrackID = -1
+
+	if dm.videoPID != 0 {
+		videoTrack, err := gortsplib.NewTrackH264(hlsSourcePayloadTypeH264, dm.sps, dm.pps)
+		if err != nil {
+			dm.parent.log(logger.Info, "ERR: unable to create H264 track: %s", err)
+			return false
+		}
+		dm.videoTrackID = len(tracks)
+		tracks = append(tracks, videoTrack)
+	}
+
+	if dm.audioPID != 0 {
+		audioTrack, err := gortsplib.NewTrackAAC(hlsSourcePayloadTypeAAC, dm.audioClockRate, dm.audioConfig)
+		if err != nil {
+			dm.parent.log(logger.Info, "ERR: unable to create AAC track: %s", err)
+			return false
+		}
+		dm.audioTrackID = len(tracks)
+		tracks = append(tracks, audioTrack)
+	}
+
+	dm.tracksReady = true
+
+	dm.parent.parent.OnSourceExternalSetReady(sourceExtSetReadyReq{
+		Tracks: tracks,
+	})
+
+	return true
+}
+
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// parseADTSHeader reads the object type, sample rate and channel config out
+// of the ADTS header (ISO/IEC 13818-7 Annex B) in front of the first AAC
+// frame, and derives the 2-byte AudioSpecificConfig gortsplib needs to
+// build the MPEG4-GENERIC track.
+func (dm *hlsSourceDemuxer) parseADTSHeader(au []byte) {
+	if len(au) < 7 || au[0] != 0xff || au[1]&0xf0 != 0xf0 {
+		return
+	}
+
+	objectType := ((au[2] >> 6) & 0x03) + 1
+	freqIdx := (au[2] >> 2) & 0x0f
+	channelConfig := ((au[2] & 0x01) << 2) | ((au[3] >> 6) & 0x03)
+
+	if int(freqIdx) >= len(adtsSampleRates) {
+		return
+	}
+
+	dm.audioClockRate = adtsSampleRates[freqIdx]
+	dm.audioConfig = []byte{
+		(objectType << 3) | (freqIdx >> 1),
+		(freqIdx << 7) | (channelConfig << 3),
+	}
+}
+
+// stripADTSHeader removes the ADTS header (7 bytes, or 9 with the optional
+// CRC) in front of a raw AAC frame, since RTP carries bare access units.
+func stripADTSHeader(au []byte) []byte {
+	if len(au) < 7 || au[0] != 0xff || au[1]&0xf0 != 0xf0 {
+		return au
+	}
+
+	headerLen := 7
+	if au[1]&0x01 == 0 {
+		headerLen = 9
+	}
+	if len(au) <= headerLen {
+		return nil
+	}
+	return au[headerLen:]
+}
+
+func pesTimestamp(pes *astits.PESData) uint32 {
+	if pes.Header == nil || pes.Header.OptionalHeader == nil || pes.Header.OptionalHeader.PTS == nil {
+		return 0
+	}
+	return uint32(pes.Header.OptionalHeader.PTS.Base & 0xffffffff)
+}
+
+// writeVideo fragments an H264 access unit into RTP packets, splitting any
+// NAL unit that doesn't fit the MTU into FU-A fragments (RFC 6184 section
+// 5.8), and forwards each one through OnSourceFrame, the same entry point
+// rtspSource uses for frames read off the wire.
+func (dm *hlsSourceDemuxer) writeVideo(nalus [][]byte, pts uint32) {
+	payloads := packetizeH264(nalus)
+
+	for i, payload := range payloads {
+		dm.videoSeq++
+
+		pkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    hlsSourcePayloadTypeH264,
+				SequenceNumber: dm.videoSeq,
+				Timestamp:      pts,
+				Marker:         i == len(payloads)-1,
+			},
+			Payload: payload,
+		}
+
+		buf, err := pkt.Marshal()
+		if err != nil {
+			continue
+		}
+
+		dm.parent.parent.OnSourceFrame(dm.videoTrackID, gortsplib.StreamTypeRTP, buf)
+	}
+}
+
+const hlsSourceRTPMTU = 1400
+
+// packetizeH264 turns a set of Annex-B NAL units into RTP payloads, one per
+// NAL unit when it fits the MTU, or a run of FU-A fragments (RFC 6184
+// section 5.8) when it doesn't.
+func packetizeH264(nalus [][]byte) [][]byte {
+	var payloads [][]byte
+
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		if len(nalu) <= hlsSourceRTPMTU {
+			payloads = append(payloads, nalu)
+			continue
+		}
+
+		fuIndicator := (nalu[0] & 0xe0) | 28
+		naluType := nalu[0] & 0x1f
+		data := nalu[1:]
+		first := true
+
+		for len(data) > 0 {
+			chunkSize := hlsSourceRTPMTU - 2
+			if chunkSize > len(data) {
+				chunkSize = len(data)
+			}
+			chunk := data[:chunkSize]
+			data = data[chunkSize:]
+
+			fuHeader := naluType
+			if first {
+				fuHeader |= 0x80
+				first = false
+			}
+			if len(data) == 0 {
+				fuHeader |= 0x40
+			}
+
+			payload := make([]byte, 0, len(chunk)+2)
+			payload = append(payload, fuIndicator, fuHeader)
+			payload = append(payload, chunk...)
+			payloads = append(payloads, payload)
+		}
+	}
+
+	return payloads
+}
+
+// writeAudio wraps a raw AAC frame in a single RTP packet using the
+// MPEG4-GENERIC AU-header layout (RFC 3640 section 3.2.1). ts is already
+// expressed in the track's own clock rate.
+func (dm *hlsSourceDemuxer) writeAudio(au []byte, ts uint32) {
+	dm.audioSeq++
+
+	auHeader := []byte{0x00, 0x10, byte(len(au) >> 5), byte(len(au)<<3) & 0xf8}
+
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    hlsSourcePayloadTypeAAC,
+			SequenceNumber: dm.audioSeq,
+			Timestamp:      ts,
+			Marker:         true,
+		},
+		Payload: append(auHeader, au...),
+	}
+
+	buf, err := pkt.Marshal()
+	if err != nil {
+		return
+	}
+
+	dm.parent.parent.OnSourceFrame(dm.audioTrackID, gortsplib.StreamTypeRTP, buf)
+}
+
+// rescalePTS converts a TS PES timestamp, always expressed in the MPEG-TS
+// 90kHz clock, into the clock rate of the track it's about to be stamped
+// onto. H264 also runs at 90kHz so this is a no-op for video, but AAC tracks
+// run at their own sample rate and need the conversion.
+func rescalePTS(pts90k uint32, clockRate int) uint32 {
+	if clockRate == 90000 || clockRate == 0 {
+		return pts90k
+	}
+	return uint32(uint64(pts90k) * uint64(clockRate) / 90000)
+}
+
+func splitAnnexB(buf []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+
+	for i := 0; i+3 <= len(buf); i++ {
+		if buf[i] == 0 && buf[i+1] == 0 && buf[i+2] == 1 {
+			if start != -1 {
+				nalus = append(nalus, trimAnnexBPadding(buf[start:i]))
+			}
+			start = i + 3
+		}
+	}
+
+	if start != -1 && start < len(buf) {
+		nalus = append(nalus, trimAnnexBPadding(buf[start:]))
+	}
+
+	return nalus
+}
+
+// trimAnnexBPadding drops every trailing zero byte of a NAL unit. Such bytes
+// appear when the next NAL unit was preceded by a 4-byte start code
+// (00 00 00 01): the last 00 00 01 is consumed as the 3-byte start code,
+// leaving the extra 00 glued onto the previous NAL unit's tail instead.
+func trimAnnexBPadding(nalu []byte) []byte {
+	end := len(nalu)
+	for end > 0 && nalu[end-1] == 0 {
+		end--
+	}
+	return nalu[:end]
+}
@@ -6,6 +6,8 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"fmt"
+	"net/url"
+	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -13,12 +15,33 @@ import (
 
 	"github.com/aler9/gortsplib"
 	"github.com/aler9/gortsplib/pkg/base"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
 const (
 	rtspSourceRetryPause = 5 * time.Second
+
+	// checkStreamInterval is the interval at which rtspSource checks that at
+	// least one track is still producing RTP packets.
+	checkStreamInterval = 5 * time.Second
+
+	// receiverReportInterval is the interval at which rtspSource sends an
+	// RTCP receiver report upstream for each track.
+	receiverReportInterval = 10 * time.Second
+)
+
+// rtspSourceRunOutcome is what runInner tells run() to do next: stop for
+// good, retry after rtspSourceRetryPause, or reconnect immediately because a
+// reload is already waiting with fresh parameters.
+type rtspSourceRunOutcome int
+
+const (
+	rtspSourceRunOutcomeStop rtspSourceRunOutcome = iota
+	rtspSourceRunOutcomeRetry
+	rtspSourceRunOutcomeReload
 )
 
 type rtspSourceParent interface {
@@ -28,11 +51,77 @@ type rtspSourceParent interface {
 	OnSourceFrame(int, gortsplib.StreamType, []byte)
 }
 
+// rtspSourceConf holds the subset of path configuration that rtspSource
+// re-reads on reload.
+//
+// proto is the already-parsed form of the path's `sourceProtocol` option;
+// the conf package (not part of this source tree yet) is expected to map
+// the "udp-multicast" string onto gortsplib.ClientProtocolUDPMulticast
+// before a rtspSourceConf ever reaches here, the same way it already maps
+// "udp"/"tcp". Until that mapping lands, the udp-multicast knob isn't
+// reachable from the YAML config, only by constructing rtspSource directly.
+type rtspSourceConf struct {
+	ur           string
+	proto        *gortsplib.ClientProtocol
+	fingerprint  string
+	user         string
+	pass         string
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// rtspSourceURLUserinfoRE matches the userinfo part of an rtsp(s) URL, and
+// rtspSourceAuthHeaderRE matches an Authorization header however it ends up
+// rendered (either "Name: value" wire format or a %v-dumped map such as
+// "Name:[value]"), so that neither ends up in debug logs. [^\r\n]* keeps
+// the match on a single line but runs to the end of it, so whatever follows
+// the header's first token on that line (in a dump with no newlines of its
+// own, the rest of the dump) is redacted along with it.
+var (
+	rtspSourceURLUserinfoRE = regexp.MustCompile(`(rtsps?://)[^/@\s]+@`)
+	rtspSourceAuthHeaderRE  = regexp.MustCompile(`(?i)(Authorization:\s*\S+)[^\r\n]*`)
+)
+
+// redactRTSPHeader returns h with its Authorization entry, if any, replaced
+// by a fixed placeholder. This is the authoritative redaction: it operates
+// on the real header values before they're formatted into a string, so it
+// doesn't depend on guessing what fmt.Sprintf("%v", ...) does with
+// base.Request/base.Response (Stringer, if one exists, or Go's default
+// struct dump otherwise).
+func redactRTSPHeader(h base.Header) base.Header {
+	if _, ok := h["Authorization"]; !ok {
+		return h
+	}
+
+	redacted := make(base.Header, len(h))
+	for k, v := range h {
+		redacted[k] = v
+	}
+	redacted["Authorization"] = base.HeaderValue{"REDACTED"}
+	return redacted
+}
+
+// redactRTSPDebugLine is a second, best-effort pass over the already
+// formatted debug line, in case credentials leak in through some other
+// field (e.g. a URL embedded in the request line or body).
+func redactRTSPDebugLine(s string) string {
+	s = rtspSourceURLUserinfoRE.ReplaceAllString(s, "$1")
+	s = rtspSourceAuthHeaderRE.ReplaceAllString(s, "$1 REDACTED")
+	return s
+}
+
 type rtspSource struct {
+	// lastFrameTime must come first: sync/atomic requires 64-bit fields
+	// accessed atomically to be 8-byte aligned, which is only guaranteed for
+	// the first word of an allocated struct on 32-bit platforms (arm, 386).
+	lastFrameTime int64 // unix nano, accessed with atomic
+
 	ur              string
 	proto           *gortsplib.ClientProtocol
 	anyPortEnable   bool
 	fingerprint     string
+	user            string
+	pass            string
 	readTimeout     time.Duration
 	writeTimeout    time.Duration
 	readBufferCount int
@@ -40,17 +129,123 @@ type rtspSource struct {
 	wg              *sync.WaitGroup
 	stats           *stats
 	parent          rtspSourceParent
+	reloadConf      chan rtspSourceConf
 
 	ctx       context.Context
 	ctxCancel func()
 }
 
+// rtspSourceTrackStats accumulates the counters needed to build an RTCP
+// receiver report for a single track, as described in RFC 3550.
+type rtspSourceTrackStats struct {
+	// clockRate is the track's RTP clock rate (e.g. 90000 for H264, or the
+	// audio sample rate); it converts wall-clock arrival times into the same
+	// units as pkt.Timestamp so transit/jitter are computed in one unit.
+	clockRate int
+
+	mutex sync.Mutex
+
+	haveSeqNR     bool
+	baseSeqNR     uint16
+	highestSeqNR  uint16
+	cycles        uint16
+	received      uint32
+	expectedPrior uint32
+	receivedPrior uint32
+	lastSSRC      uint32
+	lastTransit   int64
+	jitter        float64
+}
+
+func (st *rtspSourceTrackStats) onPacket(pkt *rtp.Packet) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.lastSSRC = pkt.SSRC
+	st.received++
+
+	if !st.haveSeqNR {
+		st.haveSeqNR = true
+		st.baseSeqNR = pkt.SequenceNumber
+		st.highestSeqNR = pkt.SequenceNumber
+		return
+	}
+
+	if pkt.SequenceNumber < st.highestSeqNR && st.highestSeqNR-pkt.SequenceNumber > 0x8000 {
+		st.cycles++
+	}
+	if pkt.SequenceNumber > st.highestSeqNR || st.highestSeqNR-pkt.SequenceNumber > 0x8000 {
+		st.highestSeqNR = pkt.SequenceNumber
+	}
+
+	// RFC 3550 section 6.4.1: both arrival and RTP timestamp must be
+	// expressed in the track's own clock rate for transit/jitter to mean
+	// anything.
+	arrival := int64(float64(time.Now().UnixNano()) * float64(st.clockRate) / 1e9)
+	transit := arrival - int64(pkt.Timestamp)
+	if st.lastTransit != 0 {
+		d := transit - st.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		st.jitter += (float64(d) - st.jitter) / 16
+	}
+	st.lastTransit = transit
+}
+
+// receiverReport builds an RTCP receiver report for this track, or nil if no
+// packet has been received yet.
+func (st *rtspSourceTrackStats) receiverReport() *rtcp.ReceiverReport {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if !st.haveSeqNR {
+		return nil
+	}
+
+	extendedHighestSeqNR := uint32(st.cycles)<<16 | uint32(st.highestSeqNR)
+	expected := extendedHighestSeqNR - uint32(st.baseSeqNR) + 1
+	lost := uint32(0)
+	if expected > st.received {
+		lost = expected - st.received
+	}
+
+	expectedInterval := expected - st.expectedPrior
+	receivedInterval := st.received - st.receivedPrior
+	st.expectedPrior = expected
+	st.receivedPrior = st.received
+
+	lostInterval := uint32(0)
+	if expectedInterval > receivedInterval {
+		lostInterval = expectedInterval - receivedInterval
+	}
+
+	fractionLost := uint8(0)
+	if expectedInterval != 0 && lostInterval != 0 {
+		fractionLost = uint8((lostInterval << 8) / expectedInterval)
+	}
+
+	return &rtcp.ReceiverReport{
+		Reports: []rtcp.ReceptionReport{
+			{
+				SSRC:               st.lastSSRC,
+				FractionLost:       fractionLost,
+				TotalLost:          lost,
+				LastSequenceNumber: extendedHighestSeqNR,
+				Jitter:             uint32(st.jitter),
+			},
+		},
+	}
+}
+
 func newRTSPSource(
 	parentCtx context.Context,
 	ur string,
 	proto *gortsplib.ClientProtocol,
 	anyPortEnable bool,
 	fingerprint string,
+	sourceUser string,
+	sourcePass string,
 	readTimeout time.Duration,
 	writeTimeout time.Duration,
 	readBufferCount int,
@@ -65,6 +260,8 @@ func newRTSPSource(
 		proto:           proto,
 		anyPortEnable:   anyPortEnable,
 		fingerprint:     fingerprint,
+		user:            sourceUser,
+		pass:            sourcePass,
 		readTimeout:     readTimeout,
 		writeTimeout:    writeTimeout,
 		readBufferCount: readBufferCount,
@@ -72,6 +269,7 @@ func newRTSPSource(
 		wg:              wg,
 		stats:           stats,
 		parent:          parent,
+		reloadConf:      make(chan rtspSourceConf, 1),
 		ctx:             ctx,
 		ctxCancel:       ctxCancel,
 	}
@@ -91,6 +289,33 @@ func (s *rtspSource) Close() {
 	s.ctxCancel()
 }
 
+// OnReloadConf is called by the path manager when the path configuration
+// changes, so that the source can reconnect with the new parameters instead
+// of running with stale ones until the next restart. It never blocks: if a
+// previous reload hasn't been picked up yet, it's replaced by this one.
+//
+// The path manager (not part of this source tree yet) is expected to call
+// this on every config reload for paths backed by a live rtspSource; until
+// that wiring lands, nothing reaches this method and reloads fall back to
+// a full restart.
+func (s *rtspSource) OnReloadConf(conf rtspSourceConf) {
+	select {
+	case s.reloadConf <- conf:
+		return
+	default:
+	}
+
+	select {
+	case <-s.reloadConf:
+	default:
+	}
+
+	select {
+	case s.reloadConf <- conf:
+	default:
+	}
+}
+
 // IsSource implements source.
 func (s *rtspSource) IsSource() {}
 
@@ -105,32 +330,198 @@ func (s *rtspSource) run() {
 	defer s.wg.Done()
 
 	for {
-		ok := func() bool {
-			ok := s.runInner()
-			if !ok {
-				return false
-			}
+		switch s.runInner() {
+		case rtspSourceRunOutcomeStop:
+			s.ctxCancel()
+			return
 
+		case rtspSourceRunOutcomeReload:
+			continue
+
+		case rtspSourceRunOutcomeRetry:
 			select {
 			case <-time.After(rtspSourceRetryPause):
-				return true
 			case <-s.ctx.Done():
-				return false
+				s.ctxCancel()
+				return
 			}
-		}()
-		if !ok {
-			break
 		}
 	}
-
-	s.ctxCancel()
 }
 
-func (s *rtspSource) runInner() bool {
+func (s *rtspSource) runInner() rtspSourceRunOutcome {
 	s.log(logger.Debug, "connecting")
 
+	multicast := s.proto != nil && *s.proto == gortsplib.ClientProtocolUDPMulticast
+
+	conn, err, canceled := s.connect(multicast)
+	if canceled {
+		return rtspSourceRunOutcomeStop
+	}
+
+	if err != nil && multicast {
+		s.log(logger.Info, "server refused multicast (%s), falling back to unicast", err)
+
+		conn, err, canceled = s.connect(false)
+		if canceled {
+			return rtspSourceRunOutcomeStop
+		}
+	}
+
+	if err != nil {
+		s.log(logger.Info, "ERR: %s", err)
+		return rtspSourceRunOutcomeRetry
+	}
+
+	s.log(logger.Info, "ready")
+
+	s.parent.OnSourceExternalSetReady(sourceExtSetReadyReq{
+		Tracks: conn.Tracks(),
+	})
+
+	defer func() {
+		s.parent.OnSourceExternalSetNotReady(sourceExtSetNotReadyReq{})
+	}()
+
+	trackStats := make([]*rtspSourceTrackStats, len(conn.Tracks()))
+	for i, track := range conn.Tracks() {
+		clockRate, err := track.ClockRate()
+		if err != nil {
+			clockRate = 90000
+		}
+		trackStats[i] = &rtspSourceTrackStats{clockRate: clockRate}
+	}
+
+	atomic.StoreInt64(&s.lastFrameTime, time.Now().UnixNano())
+
+	readErr := make(chan error)
+	go func() {
+		readErr <- conn.ReadFrames(func(trackID int, streamType gortsplib.StreamType, payload []byte) {
+			if streamType == gortsplib.StreamTypeRTP {
+				atomic.StoreInt64(&s.lastFrameTime, time.Now().UnixNano())
+
+				pkt := &rtp.Packet{}
+				if err := pkt.Unmarshal(payload); err == nil {
+					trackStats[trackID].onPacket(pkt)
+				}
+			}
+
+			s.parent.OnSourceFrame(trackID, streamType, payload)
+		})
+	}()
+
+	checkStreamTicker := time.NewTicker(checkStreamInterval)
+	defer checkStreamTicker.Stop()
+
+	receiverReportTicker := time.NewTicker(receiverReportInterval)
+	defer receiverReportTicker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			conn.Close()
+			<-readErr
+			return rtspSourceRunOutcomeStop
+
+		case err := <-readErr:
+			s.log(logger.Info, "ERR: %s", err)
+			conn.Close()
+			return rtspSourceRunOutcomeRetry
+
+		case conf := <-s.reloadConf:
+			s.log(logger.Info, "reloading configuration")
+			s.applyConf(conf)
+			conn.Close()
+			<-readErr
+			return rtspSourceRunOutcomeReload
+
+		case <-checkStreamTicker.C:
+			last := time.Unix(0, atomic.LoadInt64(&s.lastFrameTime))
+			if time.Since(last) >= s.readTimeout {
+				s.log(logger.Info, "ERR: no data received in %s", s.readTimeout)
+				conn.Close()
+				<-readErr
+				return rtspSourceRunOutcomeRetry
+			}
+
+		case <-receiverReportTicker.C:
+			s.sendReceiverReports(conn, trackStats)
+		}
+	}
+}
+
+// sendReceiverReports sends an RTCP receiver report for every track that has
+// received at least one RTP packet since the connection was established.
+func (s *rtspSource) sendReceiverReports(conn *gortsplib.ClientConn, trackStats []*rtspSourceTrackStats) {
+	for trackID, st := range trackStats {
+		rr := st.receiverReport()
+		if rr == nil {
+			continue
+		}
+
+		buf, err := rr.Marshal()
+		if err != nil {
+			continue
+		}
+
+		err = conn.WriteFrame(trackID, gortsplib.StreamTypeRTCP, buf)
+		if err != nil {
+			s.log(logger.Debug, "unable to send receiver report for track %d: %s", trackID, err)
+		}
+	}
+}
+
+// applyConf replaces the connection parameters with the ones received
+// through reloadConf. It's called by runInner itself, just before the current
+// connection is closed; the ReadFrames goroutine still running at that point
+// doesn't read these fields, so no synchronization is needed.
+func (s *rtspSource) applyConf(conf rtspSourceConf) {
+	s.ur = conf.ur
+	s.proto = conf.proto
+	s.fingerprint = conf.fingerprint
+	s.user = conf.user
+	s.pass = conf.pass
+	s.readTimeout = conf.readTimeout
+	s.writeTimeout = conf.writeTimeout
+}
+
+// urlWithCredentials returns s.ur with s.user/s.pass embedded as userinfo, if
+// they're set and the URL doesn't already carry credentials of its own.
+// gortsplib negotiates Basic/Digest auth against the server automatically
+// whenever the URL it's given has userinfo, the same way the internal RTSP
+// server validates client credentials.
+func (s *rtspSource) urlWithCredentials() (string, error) {
+	if s.user == "" {
+		return s.ur, nil
+	}
+
+	u, err := url.Parse(s.ur)
+	if err != nil {
+		return "", err
+	}
+
+	if u.User == nil {
+		u.User = url.UserPassword(s.user, s.pass)
+	}
+
+	return u.String(), nil
+}
+
+// connect dials the upstream server. If multicast is true, SETUP is performed
+// requesting RTP/AVP;multicast; the caller is responsible for retrying in
+// unicast mode if the server doesn't support it.
+func (s *rtspSource) connect(multicast bool) (conn *gortsplib.ClientConn, err error, canceled bool) {
+	proto := s.proto
+	if multicast {
+		p := gortsplib.ClientProtocolUDPMulticast
+		proto = &p
+	} else if proto != nil && *proto == gortsplib.ClientProtocolUDPMulticast {
+		p := gortsplib.ClientProtocolUDP
+		proto = &p
+	}
+
 	client := &gortsplib.Client{
-		Protocol: s.proto,
+		Protocol: proto,
 		TLSConfig: &tls.Config{
 			InsecureSkipVerify: true,
 			VerifyConnection: func(cs tls.ConnectionState) error {
@@ -153,64 +544,37 @@ func (s *rtspSource) runInner() bool {
 		ReadBufferSize:  s.readBufferSize,
 		AnyPortEnable:   s.anyPortEnable,
 		OnRequest: func(req *base.Request) {
-			s.log(logger.Debug, "c->s %v", req)
+			logReq := *req
+			logReq.Header = redactRTSPHeader(req.Header)
+			s.log(logger.Debug, "c->s %v", redactRTSPDebugLine(fmt.Sprintf("%v", &logReq)))
 		},
 		OnResponse: func(res *base.Response) {
-			s.log(logger.Debug, "s->c %v", res)
+			logRes := *res
+			logRes.Header = redactRTSPHeader(res.Header)
+			s.log(logger.Debug, "s->c %v", redactRTSPDebugLine(fmt.Sprintf("%v", &logRes)))
 		},
 	}
 
+	ur, err := s.urlWithCredentials()
+	if err != nil {
+		return nil, err, false
+	}
+
 	innerCtx, innerCtxCancel := context.WithCancel(context.Background())
+	defer innerCtxCancel()
 
-	var conn *gortsplib.ClientConn
-	var err error
 	dialDone := make(chan struct{})
 	go func() {
 		defer close(dialDone)
-		conn, err = client.DialReadContext(innerCtx, s.ur)
+		conn, err = client.DialReadContext(innerCtx, ur)
 	}()
 
 	select {
 	case <-s.ctx.Done():
-		innerCtxCancel()
 		<-dialDone
-		return false
+		return nil, nil, true
 
 	case <-dialDone:
-		innerCtxCancel()
-	}
-
-	if err != nil {
-		s.log(logger.Info, "ERR: %s", err)
-		return true
+		return conn, err, false
 	}
-
-	s.log(logger.Info, "ready")
-
-	s.parent.OnSourceExternalSetReady(sourceExtSetReadyReq{
-		Tracks: conn.Tracks(),
-	})
-
-	defer func() {
-		s.parent.OnSourceExternalSetNotReady(sourceExtSetNotReadyReq{})
-	}()
-
-	readErr := make(chan error)
-	go func() {
-		readErr <- conn.ReadFrames(func(trackID int, streamType gortsplib.StreamType, payload []byte) {
-			s.parent.OnSourceFrame(trackID, streamType, payload)
-		})
-	}()
-
-	select {
-	case <-s.ctx.Done():
-		conn.Close()
-		<-readErr
-		return false
-
-	case err := <-readErr:
-		s.log(logger.Info, "ERR: %s", err)
-		conn.Close()
-		return true
-	}
-}
\ No newline at end of file
+}